@@ -0,0 +1,463 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/uber/cadence/.gen/go/shared"
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+	"github.com/uber/cadence/common/metrics"
+)
+
+// defaultPerEventReapplyDeadline is the soft deadline budgeted per event in
+// an in-flight reapplyEvents call. It only drives stuck-call detection via
+// GetPingChecks and never aborts or times out the call itself.
+const defaultPerEventReapplyDeadline = 30 * time.Second
+
+// pingCheckTimeout bounds how long a single GetPingChecks Ping call is
+// allowed to run before the deadlock detector considers it hung. Unlike
+// perEventDeadline, this is not a budget for the reapply work itself:
+// pingInFlightCalls only locks a mutex and walks a map, so it is always
+// fast regardless of how long reapplyEvents has been stuck.
+const pingCheckTimeout = 5 * time.Second
+
+type (
+	// nDCEventsReapplier reapplies stale workflow events onto a current
+	// mutable state during n-DC conflict resolution. On error it returns
+	// the events that were successfully reapplied before the failure
+	// alongside the error, so callers can commit that partial progress
+	// instead of redoing dedup lookups for events already applied.
+	nDCEventsReapplier interface {
+		reapplyEvents(
+			ctx context.Context,
+			msBuilder mutableState,
+			historyEvents []*shared.HistoryEvent,
+			runID string,
+		) ([]*shared.HistoryEvent, error)
+	}
+
+	// NDCEventReapplyPolicy controls which history event types are eligible
+	// for reapplication. Operators can narrow or widen this table without
+	// touching call sites, since not every category of event is safe to
+	// replay onto an unrelated branch of history.
+	NDCEventReapplyPolicy struct {
+		ReapplySignal             bool
+		ReapplyCancelRequest      bool
+		ReapplyTermination        bool
+		// ReapplyExternalCompletion covers every terminal child workflow
+		// event (completed, failed, canceled, timed out, and terminated),
+		// not just the success path. Opt-in: off by default.
+		ReapplyExternalCompletion bool
+	}
+
+	// NDCEventsReapplierOption configures an nDCEventsReapplier at
+	// construction time.
+	NDCEventsReapplierOption func(*nDCEventsReapplierImpl)
+
+	nDCEventsReapplierImpl struct {
+		metricsClient metrics.Client
+		logger        log.Logger
+		policy        NDCEventReapplyPolicy
+		clusterName   string
+		sink          ReappliedEventSink
+
+		perEventDeadline time.Duration
+
+		inFlightMu sync.Mutex
+		inFlight   map[int64]*reapplyCallState
+		nextToken  int64
+	}
+
+	// reapplyCallState tracks a single in-flight reapplyEvents call so
+	// GetPingChecks can report calls that are stuck past their soft
+	// deadline.
+	reapplyCallState struct {
+		runID     string
+		msBuilder mutableState
+		startTime time.Time
+		deadline  time.Time
+	}
+)
+
+var (
+	_ nDCEventsReapplier = (*nDCEventsReapplierImpl)(nil)
+	_ common.Pingable    = (*nDCEventsReapplierImpl)(nil)
+)
+
+// defaultNDCEventReapplyPolicy reapplies signals, cancellation requests and
+// terminations. External workflow completion events are opt-in since forcing
+// them onto an unrelated branch can re-trigger parent callbacks.
+func defaultNDCEventReapplyPolicy() NDCEventReapplyPolicy {
+	return NDCEventReapplyPolicy{
+		ReapplySignal:             true,
+		ReapplyCancelRequest:      true,
+		ReapplyTermination:        true,
+		ReapplyExternalCompletion: false,
+	}
+}
+
+// WithNDCEventReapplyPolicy overrides the default set of event types eligible
+// for reapplication.
+func WithNDCEventReapplyPolicy(policy NDCEventReapplyPolicy) NDCEventsReapplierOption {
+	return func(r *nDCEventsReapplierImpl) {
+		r.policy = policy
+	}
+}
+
+// WithNDCReapplyPingDeadline overrides the per-event soft deadline used by
+// GetPingChecks to detect a reapplyEvents call stuck under lock contention.
+func WithNDCReapplyPingDeadline(deadline time.Duration) NDCEventsReapplierOption {
+	return func(r *nDCEventsReapplierImpl) {
+		r.perEventDeadline = deadline
+	}
+}
+
+// WithReappliedEventSink configures where successfully reapplied events are
+// published as CloudEvents envelopes, for downstream auditing and
+// cross-system integration. Defaults to a no-op sink.
+func WithReappliedEventSink(sink ReappliedEventSink) NDCEventsReapplierOption {
+	return func(r *nDCEventsReapplierImpl) {
+		r.sink = sink
+	}
+}
+
+// WithClusterName sets the cluster name recorded in the CloudEvents `source`
+// attribute of published envelopes.
+func WithClusterName(clusterName string) NDCEventsReapplierOption {
+	return func(r *nDCEventsReapplierImpl) {
+		r.clusterName = clusterName
+	}
+}
+
+func newNDCEventsReapplier(
+	metricsClient metrics.Client,
+	logger log.Logger,
+	opts ...NDCEventsReapplierOption,
+) nDCEventsReapplier {
+
+	r := &nDCEventsReapplierImpl{
+		metricsClient:    metricsClient,
+		logger:           logger,
+		policy:           defaultNDCEventReapplyPolicy(),
+		sink:             newNoopReappliedEventSink(),
+		perEventDeadline: defaultPerEventReapplyDeadline,
+		inFlight:         make(map[int64]*reapplyCallState),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// GetPingChecks implements common.Pingable so a central deadlock-detector
+// goroutine can poll for reapplyEvents calls stuck under lock contention.
+//
+// Whatever constructs the production nDCEventsReapplier (retry- and
+// batch-wrapped) for the history service must type-assert it to
+// common.Pingable and append the result to the same slice of checks the
+// shard controller already polls, the same way every other Pingable
+// component in the history service is registered. This package only owns
+// the reapplier side of that contract; it does not import or construct the
+// shard controller itself.
+func (r *nDCEventsReapplierImpl) GetPingChecks() []common.PingCheck {
+	return []common.PingCheck{
+		{
+			Name:    "n-DC events reapplier",
+			Timeout: pingCheckTimeout,
+			Ping:    r.pingInFlightCalls,
+		},
+	}
+}
+
+func (r *nDCEventsReapplierImpl) pingInFlightCalls() []string {
+	now := time.Now()
+
+	r.inFlightMu.Lock()
+	defer r.inFlightMu.Unlock()
+
+	var stuck []string
+	for _, call := range r.inFlight {
+		if now.Before(call.deadline) {
+			continue
+		}
+		stuck = append(stuck, fmt.Sprintf(
+			"reapplyEvents stuck for %s: domainID=%s runID=%s",
+			now.Sub(call.startTime),
+			call.msBuilder.GetExecutionInfo().DomainID,
+			call.runID,
+		))
+	}
+	return stuck
+}
+
+func (r *nDCEventsReapplierImpl) registerInFlight(msBuilder mutableState, runID string, numEvents int) int64 {
+	r.inFlightMu.Lock()
+	defer r.inFlightMu.Unlock()
+
+	r.nextToken++
+	token := r.nextToken
+	now := time.Now()
+	r.inFlight[token] = &reapplyCallState{
+		runID:     runID,
+		msBuilder: msBuilder,
+		startTime: now,
+		deadline:  now.Add(time.Duration(numEvents) * r.perEventDeadline),
+	}
+	return token
+}
+
+func (r *nDCEventsReapplierImpl) unregisterInFlight(token int64) {
+	r.inFlightMu.Lock()
+	defer r.inFlightMu.Unlock()
+	delete(r.inFlight, token)
+}
+
+// publishReapplied sends a CloudEvents envelope for a successfully
+// reapplied event to the configured sink. It never fails reapplyEvents: a
+// sink error is logged and swallowed since publishing is a best-effort side
+// channel, not part of the reapply contract.
+func (r *nDCEventsReapplierImpl) publishReapplied(
+	ctx context.Context,
+	msBuilder mutableState,
+	event *shared.HistoryEvent,
+	attr interface{},
+	runID string,
+) {
+	if _, isNoop := r.sink.(*noopReappliedEventSink); isNoop {
+		return
+	}
+
+	execution := msBuilder.GetExecutionInfo()
+	envelope, err := newReappliedEventEnvelope(r.clusterName, execution.DomainID, execution.WorkflowID, runID, event, attr)
+	if err != nil {
+		r.logger.Error("failed to build reapplied event envelope", tag.Error(err))
+		return
+	}
+	if err := r.sink.Publish(ctx, envelope); err != nil {
+		r.logger.Error("failed to publish reapplied event", tag.Error(err))
+	}
+}
+
+func (r *nDCEventsReapplierImpl) reapplyEvents(
+	ctx context.Context,
+	msBuilder mutableState,
+	historyEvents []*shared.HistoryEvent,
+	runID string,
+) ([]*shared.HistoryEvent, error) {
+
+	token := r.registerInFlight(msBuilder, runID, len(historyEvents))
+	defer r.unregisterInFlight(token)
+
+	reappliedEvents := make([]*shared.HistoryEvent, 0, len(historyEvents))
+	for _, event := range historyEvents {
+		switch event.GetEventType() {
+		case shared.EventTypeWorkflowExecutionSignaled:
+			if !r.policy.ReapplySignal {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated signal event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.WorkflowExecutionSignaledEventAttributes
+			if _, err := msBuilder.AddWorkflowExecutionSignaled(
+				attr.GetSignalName(),
+				attr.GetInput(),
+				attr.GetIdentity(),
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+
+		case shared.EventTypeWorkflowExecutionCancelRequested:
+			if !r.policy.ReapplyCancelRequest {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated cancel request event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.WorkflowExecutionCancelRequestedEventAttributes
+			if _, err := msBuilder.AddWorkflowExecutionCancelRequestedEvent(
+				attr.GetCause(),
+				attr.GetIdentity(),
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+
+		case shared.EventTypeWorkflowExecutionTerminated:
+			if !r.policy.ReapplyTermination {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated termination event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.WorkflowExecutionTerminatedEventAttributes
+			if _, err := msBuilder.AddWorkflowExecutionTerminatedEvent(
+				attr.GetReason(),
+				attr.GetDetails(),
+				attr.GetIdentity(),
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+
+		case shared.EventTypeChildWorkflowExecutionCompleted:
+			if !r.policy.ReapplyExternalCompletion {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated external completion event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.ChildWorkflowExecutionCompletedEventAttributes
+			if _, err := msBuilder.AddChildWorkflowExecutionCompletedEvent(
+				attr.GetInitiatedEventId(),
+				attr.GetWorkflowExecution(),
+				attr,
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+
+		case shared.EventTypeChildWorkflowExecutionFailed:
+			if !r.policy.ReapplyExternalCompletion {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated external completion event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.ChildWorkflowExecutionFailedEventAttributes
+			if _, err := msBuilder.AddChildWorkflowExecutionFailedEvent(
+				attr.GetInitiatedEventId(),
+				attr.GetWorkflowExecution(),
+				attr,
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+
+		case shared.EventTypeChildWorkflowExecutionCanceled:
+			if !r.policy.ReapplyExternalCompletion {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated external completion event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.ChildWorkflowExecutionCanceledEventAttributes
+			if _, err := msBuilder.AddChildWorkflowExecutionCanceledEvent(
+				attr.GetInitiatedEventId(),
+				attr.GetWorkflowExecution(),
+				attr,
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+
+		case shared.EventTypeChildWorkflowExecutionTimedOut:
+			if !r.policy.ReapplyExternalCompletion {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated external completion event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.ChildWorkflowExecutionTimedOutEventAttributes
+			if _, err := msBuilder.AddChildWorkflowExecutionTimedOutEvent(
+				attr.GetInitiatedEventId(),
+				attr.GetWorkflowExecution(),
+				attr,
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+
+		case shared.EventTypeChildWorkflowExecutionTerminated:
+			if !r.policy.ReapplyExternalCompletion {
+				continue
+			}
+			if msBuilder.IsEventReapplied(runID, event.GetEventId(), event.GetVersion()) {
+				r.logger.Debug("skip reapply duplicated external completion event", tag.WorkflowRunID(runID))
+				continue
+			}
+			if !msBuilder.IsWorkflowExecutionRunning() {
+				continue
+			}
+			attr := event.ChildWorkflowExecutionTerminatedEventAttributes
+			if _, err := msBuilder.AddChildWorkflowExecutionTerminatedEvent(
+				attr.GetInitiatedEventId(),
+				attr.GetWorkflowExecution(),
+				attr,
+			); err != nil {
+				return reappliedEvents, err
+			}
+			msBuilder.UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+			reappliedEvents = append(reappliedEvents, event)
+			r.publishReapplied(ctx, msBuilder, event, attr, runID)
+		}
+	}
+	return reappliedEvents, nil
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/uber/cadence/.gen/go/shared"
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/dynamicconfig"
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+	"github.com/uber/cadence/common/metrics"
+)
+
+// defaultNDCReapplyConcurrency bounds the worker pool used by
+// reapplyEventsBatch when no NDCReapplyConcurrencyFn is configured.
+const defaultNDCReapplyConcurrency = 10
+
+type (
+	// ReapplyRequest is a single workflow's worth of work for
+	// reapplyEventsBatch: the mutableState to reapply onto, the runID the
+	// events originated from, and the events themselves.
+	ReapplyRequest struct {
+		MsBuilder     mutableState
+		RunID         string
+		HistoryEvents []*shared.HistoryEvent
+	}
+
+	// ReapplyResult is the outcome of reapplying a single ReapplyRequest. Err
+	// is non-nil if reapplication failed for that request only; it never
+	// aborts the rest of the batch.
+	ReapplyResult struct {
+		ReappliedEvents []*shared.HistoryEvent
+		Err             error
+	}
+
+	// NDCReapplyConcurrencyFn returns the current worker-pool size for
+	// reapplyEventsBatch. It is re-read on every batch call so it can be
+	// backed by a dynamic config knob, e.g. history.nDCReapplyConcurrency,
+	// without requiring the client to be rebuilt. Construct one from a
+	// live dynamic config property with WithNDCReapplyDynamicConcurrency
+	// rather than closing over a fixed int, so operators can retune it
+	// without a restart.
+	NDCReapplyConcurrencyFn func() int
+
+	// nDCEventsReapplierBatch is implemented by an nDCEventsReapplier
+	// decorator that can fan a batch of per-workflow reapply requests out
+	// across a bounded worker pool. It is kept separate from
+	// nDCEventsReapplier, the same way common.Pingable is, since not every
+	// caller needs batching.
+	nDCEventsReapplierBatch interface {
+		reapplyEventsBatch(ctx context.Context, requests []ReapplyRequest) ([]ReapplyResult, error)
+	}
+
+	// NDCEventsReapplierBatchClientOption configures an
+	// nDCEventsReapplierBatchClient at construction time.
+	NDCEventsReapplierBatchClientOption func(*nDCEventsReapplierBatchClient)
+
+	nDCEventsReapplierBatchClient struct {
+		reapplier     nDCEventsReapplier
+		metricsClient metrics.Client
+		logger        log.Logger
+		concurrency   NDCReapplyConcurrencyFn
+	}
+)
+
+var (
+	_ nDCEventsReapplier      = (*nDCEventsReapplierBatchClient)(nil)
+	_ nDCEventsReapplierBatch = (*nDCEventsReapplierBatchClient)(nil)
+	_ common.Pingable         = (*nDCEventsReapplierBatchClient)(nil)
+)
+
+// WithNDCReapplyBatchConcurrency overrides the default worker-pool size used
+// by reapplyEventsBatch.
+func WithNDCReapplyBatchConcurrency(concurrency NDCReapplyConcurrencyFn) NDCEventsReapplierBatchClientOption {
+	return func(c *nDCEventsReapplierBatchClient) {
+		c.concurrency = concurrency
+	}
+}
+
+// WithNDCReapplyDynamicConcurrency is the production wiring for
+// WithNDCReapplyBatchConcurrency: it derives the worker-pool size from the
+// history.nDCReapplyConcurrency dynamic config property, so the limit can be
+// tuned per cluster without rebuilding the client or restarting the
+// history service.
+func WithNDCReapplyDynamicConcurrency(property dynamicconfig.IntPropertyFn) NDCEventsReapplierBatchClientOption {
+	return WithNDCReapplyBatchConcurrency(func() int { return property() })
+}
+
+// newNDCEventsReapplierBatchClient wraps an nDCEventsReapplier with a
+// reapplyEventsBatch method that processes many workflows' reapply requests
+// concurrently instead of serializing them one mutableState at a time, which
+// otherwise becomes the bottleneck when a replication task fans out signals
+// to many child workflows.
+func newNDCEventsReapplierBatchClient(
+	reapplier nDCEventsReapplier,
+	metricsClient metrics.Client,
+	logger log.Logger,
+	opts ...NDCEventsReapplierBatchClientOption,
+) *nDCEventsReapplierBatchClient {
+
+	c := &nDCEventsReapplierBatchClient{
+		reapplier:     reapplier,
+		metricsClient: metricsClient,
+		logger:        logger,
+		concurrency:   func() int { return defaultNDCReapplyConcurrency },
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// GetPingChecks forwards to the wrapped reapplier's Pingable implementation,
+// if it has one, so layering batching on top of the base nDCEventsReapplier
+// (or a retryable decorator around it) does not hide stuck-call detection
+// from the deadlock-detector goroutine.
+func (c *nDCEventsReapplierBatchClient) GetPingChecks() []common.PingCheck {
+	if pingable, ok := c.reapplier.(common.Pingable); ok {
+		return pingable.GetPingChecks()
+	}
+	return nil
+}
+
+func (c *nDCEventsReapplierBatchClient) reapplyEvents(
+	ctx context.Context,
+	msBuilder mutableState,
+	historyEvents []*shared.HistoryEvent,
+	runID string,
+) ([]*shared.HistoryEvent, error) {
+	return c.reapplier.reapplyEvents(ctx, msBuilder, historyEvents, runID)
+}
+
+// reapplyEventsBatch reapplies each request's events onto its own
+// mutableState, in request order, using a worker pool bounded by
+// NDCReapplyConcurrencyFn. The returned slice is positional: results[i]
+// corresponds to requests[i], regardless of completion order, and a failing
+// request never prevents the others from completing.
+func (c *nDCEventsReapplierBatchClient) reapplyEventsBatch(
+	ctx context.Context,
+	requests []ReapplyRequest,
+) ([]ReapplyResult, error) {
+
+	results := make([]ReapplyResult, len(requests))
+	if len(requests) == 0 {
+		return results, nil
+	}
+
+	workers := c.concurrency()
+	if workers <= 0 {
+		workers = defaultNDCReapplyConcurrency
+	}
+	if workers > len(requests) {
+		workers = len(requests)
+	}
+
+	indexCh := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexCh {
+				results[idx] = c.reapplyOneSafe(ctx, requests[idx])
+			}
+		}()
+	}
+	for i := range requests {
+		indexCh <- i
+	}
+	close(indexCh)
+	wg.Wait()
+
+	return results, nil
+}
+
+// reapplyOneSafe isolates a panic in a single request to that request's
+// ReapplyResult, so one malformed workflow (e.g. a nil MsBuilder) cannot
+// take down the worker goroutine and, with it, every other result the batch
+// was about to produce.
+func (c *nDCEventsReapplierBatchClient) reapplyOneSafe(ctx context.Context, req ReapplyRequest) (result ReapplyResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("panic reapplying events for runID %s: %v", req.RunID, r)
+			result = ReapplyResult{Err: err}
+			c.logger.Error("panic reapplying events in batch", tag.WorkflowRunID(req.RunID), tag.Error(err))
+		}
+	}()
+	return c.reapplyOne(ctx, req)
+}
+
+func (c *nDCEventsReapplierBatchClient) reapplyOne(ctx context.Context, req ReapplyRequest) ReapplyResult {
+	domainID := req.MsBuilder.GetExecutionInfo().DomainID
+	scope := c.metricsClient.Scope(metrics.HistoryReapplyEventsScope, metrics.DomainTag(domainID))
+
+	reapplied, err := c.reapplier.reapplyEvents(ctx, req.MsBuilder, req.HistoryEvents, req.RunID)
+	if err != nil {
+		scope.IncCounter(metrics.EventReapplyFailedCount)
+		c.logger.Error("failed to reapply events in batch",
+			tag.WorkflowDomainID(domainID),
+			tag.WorkflowRunID(req.RunID),
+			tag.Error(err),
+		)
+		return ReapplyResult{ReappliedEvents: reapplied, Err: err}
+	}
+
+	scope.IncCounter(metrics.EventReapplySucceededCount)
+	return ReapplyResult{ReappliedEvents: reapplied}
+}
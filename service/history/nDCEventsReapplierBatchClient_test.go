@@ -0,0 +1,242 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/.gen/go/shared"
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/dynamicconfig"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+	"github.com/uber/cadence/common/persistence"
+)
+
+type (
+	nDCEventsReapplierBatchClientSuite struct {
+		suite.Suite
+		*require.Assertions
+
+		controller *gomock.Controller
+
+		client *nDCEventsReapplierBatchClient
+	}
+)
+
+func TestNDCEventsReapplierBatchClientSuite(t *testing.T) {
+	s := new(nDCEventsReapplierBatchClientSuite)
+	suite.Run(t, s)
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) newClient(reapplier nDCEventsReapplier, opts ...NDCEventsReapplierBatchClientOption) *nDCEventsReapplierBatchClient {
+	logger := loggerimpl.NewDevelopmentForTest(s.Suite)
+	metricsClient := metrics.NewClient(tally.NoopScope, metrics.History)
+	return newNDCEventsReapplierBatchClient(reapplier, metricsClient, logger, opts...)
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) newSignalRequest(runID string) (ReapplyRequest, *shared.HistoryEvent) {
+	execution := &persistence.WorkflowExecutionInfo{DomainID: uuid.New()}
+	event := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal"),
+			Input:      []byte{},
+		},
+	}
+	attr := event.WorkflowExecutionSignaledEventAttributes
+
+	msBuilder := NewMockmutableState(s.controller)
+	msBuilder.EXPECT().IsWorkflowExecutionRunning().Return(true)
+	msBuilder.EXPECT().GetExecutionInfo().Return(execution).AnyTimes()
+	msBuilder.EXPECT().IsEventReapplied(runID, event.GetEventId(), event.GetVersion()).Return(false)
+	msBuilder.EXPECT().AddWorkflowExecutionSignaled(
+		attr.GetSignalName(), attr.GetInput(), attr.GetIdentity(),
+	).Return(event, nil)
+	msBuilder.EXPECT().UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+
+	return ReapplyRequest{
+		MsBuilder:     msBuilder,
+		RunID:         runID,
+		HistoryEvents: []*shared.HistoryEvent{event},
+	}, event
+}
+
+// TestReapplyEventsBatch_Error mirrors the single-call TestReapplyEvents_Error
+// case, but inside a batch that also contains several succeeding workflows,
+// asserting the failing one does not prevent the others from reapplying.
+func (s *nDCEventsReapplierBatchClientSuite) TestReapplyEventsBatch_Error() {
+	reapplier := newNDCEventsReapplier(
+		metrics.NewClient(tally.NoopScope, metrics.History),
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+	)
+	s.client = s.newClient(reapplier)
+
+	const numGood = 4
+	requests := make([]ReapplyRequest, 0, numGood+1)
+	expectedEvents := make([]*shared.HistoryEvent, numGood+1)
+	for i := 0; i < numGood; i++ {
+		req, event := s.newSignalRequest(uuid.New())
+		requests = append(requests, req)
+		expectedEvents[i] = event
+	}
+
+	failRunID := uuid.New()
+	failEvent := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal"),
+			Input:      []byte{},
+		},
+	}
+	failAttr := failEvent.WorkflowExecutionSignaledEventAttributes
+	failMsBuilder := NewMockmutableState(s.controller)
+	failMsBuilder.EXPECT().IsWorkflowExecutionRunning().Return(true)
+	failMsBuilder.EXPECT().GetExecutionInfo().Return(&persistence.WorkflowExecutionInfo{DomainID: uuid.New()}).AnyTimes()
+	failMsBuilder.EXPECT().IsEventReapplied(failRunID, failEvent.GetEventId(), failEvent.GetVersion()).Return(false)
+	failMsBuilder.EXPECT().AddWorkflowExecutionSignaled(
+		failAttr.GetSignalName(), failAttr.GetInput(), failAttr.GetIdentity(),
+	).Return(nil, fmt.Errorf("test"))
+	requests = append(requests, ReapplyRequest{
+		MsBuilder:     failMsBuilder,
+		RunID:         failRunID,
+		HistoryEvents: []*shared.HistoryEvent{failEvent},
+	})
+	expectedEvents[numGood] = nil
+
+	results, err := s.client.reapplyEventsBatch(context.Background(), requests)
+	s.NoError(err)
+	s.Len(results, numGood+1)
+
+	for i := 0; i < numGood; i++ {
+		s.NoError(results[i].Err)
+		s.Equal([]*shared.HistoryEvent{expectedEvents[i]}, results[i].ReappliedEvents)
+	}
+	s.Error(results[numGood].Err)
+	s.Empty(results[numGood].ReappliedEvents)
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) TestWithNDCReapplyDynamicConcurrency_ReadsPropertyOnEveryCall() {
+	var current int32 = 1
+	property := func(...dynamicconfig.FilterOption) int { return int(atomic.LoadInt32(&current)) }
+
+	s.client = s.newClient(NewMocknDCEventsReapplier(s.controller), WithNDCReapplyDynamicConcurrency(property))
+	s.Equal(1, s.client.concurrency())
+
+	atomic.StoreInt32(&current, 4)
+	s.Equal(4, s.client.concurrency())
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) TestReapplyEventsBatch_Empty() {
+	s.client = s.newClient(NewMocknDCEventsReapplier(s.controller))
+	results, err := s.client.reapplyEventsBatch(context.Background(), nil)
+	s.NoError(err)
+	s.Empty(results)
+}
+
+// TestReapplyEventsBatch_BoundedConcurrency asserts that at most the
+// configured number of requests are in flight against the wrapped reapplier
+// at any one time.
+func (s *nDCEventsReapplierBatchClientSuite) TestReapplyEventsBatch_BoundedConcurrency() {
+	const concurrency = 2
+	const numRequests = 6
+
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+
+	inner := NewMocknDCEventsReapplier(s.controller)
+	inner.EXPECT().
+		reapplyEvents(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(context.Context, mutableState, []*shared.HistoryEvent, string) ([]*shared.HistoryEvent, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil, nil
+		}).
+		Times(numRequests)
+
+	s.client = s.newClient(inner, WithNDCReapplyBatchConcurrency(func() int { return concurrency }))
+
+	requests := make([]ReapplyRequest, numRequests)
+	for i := range requests {
+		msBuilder := NewMockmutableState(s.controller)
+		msBuilder.EXPECT().GetExecutionInfo().Return(&persistence.WorkflowExecutionInfo{DomainID: uuid.New()}).AnyTimes()
+		requests[i] = ReapplyRequest{
+			MsBuilder: msBuilder,
+			RunID:     uuid.New(),
+		}
+	}
+
+	_, err := s.client.reapplyEventsBatch(context.Background(), requests)
+	s.NoError(err)
+	s.LessOrEqual(maxInFlight, concurrency)
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) TestGetPingChecks_ForwardsToWrappedPingable() {
+	inner := newNDCEventsReapplier(
+		metrics.NewClient(tally.NoopScope, metrics.History),
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+	)
+	s.client = s.newClient(inner)
+	s.Len(s.client.GetPingChecks(), 1)
+}
+
+func (s *nDCEventsReapplierBatchClientSuite) TestGetPingChecks_NilForNonPingableInner() {
+	s.client = s.newClient(NewMocknDCEventsReapplier(s.controller))
+	s.Nil(s.client.GetPingChecks())
+}
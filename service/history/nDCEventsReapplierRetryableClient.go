@@ -0,0 +1,144 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"context"
+	"time"
+
+	"github.com/uber/cadence/.gen/go/shared"
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/persistence"
+)
+
+type (
+	// NDCEventsReapplierRetryableClientOption configures an
+	// nDCEventsReapplierRetryableClient at construction time.
+	NDCEventsReapplierRetryableClientOption func(*nDCEventsReapplierRetryableClient)
+
+	nDCEventsReapplierRetryableClient struct {
+		reapplier   nDCEventsReapplier
+		policy      backoff.RetryPolicy
+		isRetryable backoff.IsRetryable
+	}
+)
+
+var (
+	_ nDCEventsReapplier = (*nDCEventsReapplierRetryableClient)(nil)
+	_ common.Pingable    = (*nDCEventsReapplierRetryableClient)(nil)
+)
+
+// WithNDCReapplyRetryPolicy overrides the default retry policy used between
+// reapply attempts.
+func WithNDCReapplyRetryPolicy(policy backoff.RetryPolicy) NDCEventsReapplierRetryableClientOption {
+	return func(c *nDCEventsReapplierRetryableClient) {
+		c.policy = policy
+	}
+}
+
+// newNDCEventsReapplierRetryableClient wraps an nDCEventsReapplier with
+// exponential-backoff retries, classifying errors so that a transient
+// failure (e.g. a shard movement mid-reapply) does not discard progress
+// already made on a batch of events.
+func newNDCEventsReapplierRetryableClient(
+	reapplier nDCEventsReapplier,
+	opts ...NDCEventsReapplierRetryableClientOption,
+) nDCEventsReapplier {
+
+	c := &nDCEventsReapplierRetryableClient{
+		reapplier:   reapplier,
+		policy:      createNDCReapplyEventsRetryPolicy(),
+		isRetryable: IsReapplicationTransientError,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// GetPingChecks forwards to the wrapped reapplier's Pingable implementation,
+// if it has one, so layering retries on top of the base nDCEventsReapplier
+// does not hide stuck-call detection from the deadlock-detector goroutine.
+func (c *nDCEventsReapplierRetryableClient) GetPingChecks() []common.PingCheck {
+	if pingable, ok := c.reapplier.(common.Pingable); ok {
+		return pingable.GetPingChecks()
+	}
+	return nil
+}
+
+func (c *nDCEventsReapplierRetryableClient) reapplyEvents(
+	ctx context.Context,
+	msBuilder mutableState,
+	historyEvents []*shared.HistoryEvent,
+	runID string,
+) ([]*shared.HistoryEvent, error) {
+
+	var (
+		reapplied []*shared.HistoryEvent
+		opErr     error
+	)
+	op := func() error {
+		attemptReapplied, err := c.reapplier.reapplyEvents(ctx, msBuilder, historyEvents, runID)
+		reapplied = append(reapplied, attemptReapplied...)
+		opErr = err
+		return opErr
+	}
+
+	// Each retry reprocesses the full event slice, but the underlying
+	// reapplier's dedup check (IsEventReapplied) makes already-applied
+	// events a no-op on that attempt, so a single attempt's return value
+	// only covers events newly reapplied during that attempt. Accumulate
+	// across attempts instead of reassigning so events committed on an
+	// earlier, partially-successful attempt are not dropped from the
+	// slice this method ultimately returns.
+	retryErr := backoff.Retry(op, c.policy, c.isRetryable)
+	return reapplied, retryErr
+}
+
+// IsReapplicationTransientError classifies errors returned from
+// nDCEventsReapplier.reapplyEvents so the retryable client knows whether
+// retrying is worthwhile.
+func IsReapplicationTransientError(err error) bool {
+	switch err.(type) {
+	case *shared.DomainNotActiveError:
+		// the domain is not active in this cluster; retrying here will not
+		// help, the replication task needs to be redirected instead.
+		return false
+	case *persistence.ShardOwnershipLostError:
+		return true
+	case *persistence.TimeoutError:
+		return true
+	case *persistence.ConditionFailedError:
+		// mutable state moved out from under us; the next attempt reloads
+		// it and the version check is expected to pass.
+		return true
+	default:
+		return false
+	}
+}
+
+func createNDCReapplyEventsRetryPolicy() backoff.RetryPolicy {
+	policy := backoff.NewExponentialRetryPolicy(50 * time.Millisecond)
+	policy.SetMaximumInterval(2 * time.Second)
+	policy.SetExpirationInterval(30 * time.Second)
+	return policy
+}
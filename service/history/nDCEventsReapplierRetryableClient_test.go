@@ -0,0 +1,208 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/.gen/go/shared"
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+	"github.com/uber/cadence/common/persistence"
+)
+
+type (
+	nDCEventsReapplierRetryableClientSuite struct {
+		suite.Suite
+		*require.Assertions
+
+		controller *gomock.Controller
+
+		client nDCEventsReapplier
+	}
+)
+
+func TestNDCEventsReapplierRetryableClientSuite(t *testing.T) {
+	s := new(nDCEventsReapplierRetryableClientSuite)
+	suite.Run(t, s)
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) newFastRetryClient(reapplier nDCEventsReapplier) nDCEventsReapplier {
+	policy := backoff.NewExponentialRetryPolicy(time.Millisecond)
+	policy.SetMaximumInterval(5 * time.Millisecond)
+	policy.SetExpirationInterval(time.Second)
+	return newNDCEventsReapplierRetryableClient(reapplier, WithNDCReapplyRetryPolicy(policy))
+}
+
+// newRealReapplier wraps the production nDCEventsReapplier, rather than a
+// mock of the inner interface, so these tests exercise the real dedup path
+// (IsEventReapplied/UpdateReappliedEvent) that makes a retried attempt's
+// return value cover only events newly applied on that attempt.
+func (s *nDCEventsReapplierRetryableClientSuite) newRealReapplier() nDCEventsReapplier {
+	logger := loggerimpl.NewDevelopmentForTest(s.Suite)
+	metricsClient := metrics.NewClient(tally.NoopScope, metrics.History)
+	return newNDCEventsReapplier(metricsClient, logger)
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) TestReapplyEvents_EventualConvergenceOnTransientError() {
+	runID := uuid.New()
+	event1 := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal-1"),
+			Input:      []byte{},
+		},
+	}
+	event2 := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(2),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal-2"),
+			Input:      []byte{},
+		},
+	}
+	attr1 := event1.WorkflowExecutionSignaledEventAttributes
+	attr2 := event2.WorkflowExecutionSignaledEventAttributes
+	events := []*shared.HistoryEvent{event1, event2}
+
+	msBuilder := NewMockmutableState(s.controller)
+	msBuilder.EXPECT().IsWorkflowExecutionRunning().Return(true).Times(3)
+
+	// event1 is applied successfully on the first attempt, so the second
+	// attempt's dedup check must see it as already reapplied.
+	gomock.InOrder(
+		msBuilder.EXPECT().IsEventReapplied(runID, event1.GetEventId(), event1.GetVersion()).Return(false),
+		msBuilder.EXPECT().IsEventReapplied(runID, event1.GetEventId(), event1.GetVersion()).Return(true),
+	)
+	msBuilder.EXPECT().AddWorkflowExecutionSignaled(
+		attr1.GetSignalName(), attr1.GetInput(), attr1.GetIdentity(),
+	).Return(event1, nil).Times(1)
+	msBuilder.EXPECT().UpdateReappliedEvent(runID, event1.GetEventId(), event1.GetVersion()).Times(1)
+
+	// event2 fails transiently on the first attempt and is retried, still
+	// undeduped, on the second.
+	msBuilder.EXPECT().IsEventReapplied(runID, event2.GetEventId(), event2.GetVersion()).Return(false).Times(2)
+	gomock.InOrder(
+		msBuilder.EXPECT().AddWorkflowExecutionSignaled(
+			attr2.GetSignalName(), attr2.GetInput(), attr2.GetIdentity(),
+		).Return(nil, &persistence.TimeoutError{Msg: "timeout"}),
+		msBuilder.EXPECT().AddWorkflowExecutionSignaled(
+			attr2.GetSignalName(), attr2.GetInput(), attr2.GetIdentity(),
+		).Return(event2, nil),
+	)
+	msBuilder.EXPECT().UpdateReappliedEvent(runID, event2.GetEventId(), event2.GetVersion()).Times(1)
+
+	s.client = s.newFastRetryClient(s.newRealReapplier())
+	reapplied, err := s.client.reapplyEvents(context.Background(), msBuilder, events, runID)
+	s.NoError(err)
+	// event1 was returned by the first attempt and event2 by the second;
+	// the retryable client must accumulate both rather than keep only the
+	// last attempt's partial result.
+	s.Equal(events, reapplied)
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) TestReapplyEvents_NonTransientErrorReturnsPartialProgress() {
+	runID := uuid.New()
+	event1 := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal-1"),
+			Input:      []byte{},
+		},
+	}
+	event2 := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(2),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal-2"),
+			Input:      []byte{},
+		},
+	}
+	attr1 := event1.WorkflowExecutionSignaledEventAttributes
+	attr2 := event2.WorkflowExecutionSignaledEventAttributes
+	events := []*shared.HistoryEvent{event1, event2}
+
+	msBuilder := NewMockmutableState(s.controller)
+	msBuilder.EXPECT().IsWorkflowExecutionRunning().Return(true).Times(2)
+	msBuilder.EXPECT().IsEventReapplied(runID, event1.GetEventId(), event1.GetVersion()).Return(false)
+	msBuilder.EXPECT().AddWorkflowExecutionSignaled(
+		attr1.GetSignalName(), attr1.GetInput(), attr1.GetIdentity(),
+	).Return(event1, nil)
+	msBuilder.EXPECT().UpdateReappliedEvent(runID, event1.GetEventId(), event1.GetVersion())
+
+	msBuilder.EXPECT().IsEventReapplied(runID, event2.GetEventId(), event2.GetVersion()).Return(false)
+	msBuilder.EXPECT().AddWorkflowExecutionSignaled(
+		attr2.GetSignalName(), attr2.GetInput(), attr2.GetIdentity(),
+	).Return(nil, &shared.DomainNotActiveError{Message: common.StringPtr("not active")})
+
+	s.client = s.newFastRetryClient(s.newRealReapplier())
+	reapplied, err := s.client.reapplyEvents(context.Background(), msBuilder, events, runID)
+	s.Error(err)
+	s.Equal([]*shared.HistoryEvent{event1}, reapplied)
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) TestGetPingChecks_ForwardsToWrappedPingable() {
+	client := newNDCEventsReapplierRetryableClient(s.newRealReapplier())
+	pingable, ok := client.(common.Pingable)
+	s.True(ok, "retryable client must still satisfy common.Pingable when wrapping a Pingable reapplier")
+	s.Len(pingable.GetPingChecks(), 1)
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) TestGetPingChecks_NilForNonPingableInner() {
+	inner := NewMocknDCEventsReapplier(s.controller)
+	client := newNDCEventsReapplierRetryableClient(inner)
+	pingable, ok := client.(common.Pingable)
+	s.True(ok)
+	s.Nil(pingable.GetPingChecks())
+}
+
+func (s *nDCEventsReapplierRetryableClientSuite) TestIsReapplicationTransientError() {
+	s.True(IsReapplicationTransientError(&persistence.TimeoutError{Msg: "t"}))
+	s.True(IsReapplicationTransientError(&persistence.ShardOwnershipLostError{Msg: "s"}))
+	s.True(IsReapplicationTransientError(&persistence.ConditionFailedError{Msg: "c"}))
+	s.False(IsReapplicationTransientError(&shared.DomainNotActiveError{Message: common.StringPtr("d")}))
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/uber/cadence/.gen/go/shared"
+	"github.com/uber/cadence/common/backoff"
+)
+
+type (
+	// ReappliedEventEnvelope is a CloudEvents 1.0 envelope describing a
+	// single history event that was reapplied during n-DC conflict
+	// resolution.
+	ReappliedEventEnvelope struct {
+		SpecVersion     string          `json:"specversion"`
+		Type            string          `json:"type"`
+		Source          string          `json:"source"`
+		ID              string          `json:"id"`
+		Subject         string          `json:"subject"`
+		DataContentType string          `json:"datacontenttype"`
+		Data            json.RawMessage `json:"data"`
+	}
+
+	// ReappliedEventSink receives a CloudEvents envelope for every history
+	// event successfully reapplied by an nDCEventsReapplier.
+	ReappliedEventSink interface {
+		Publish(ctx context.Context, envelope *ReappliedEventEnvelope) error
+
+		// Close releases any resources (goroutines, connections) held by
+		// the sink. It is a no-op for sinks that hold none. Callers must
+		// call it when done with a sink constructed with a background
+		// flush loop (e.g. HTTPReappliedEventSinkConfig.FlushInterval > 0).
+		Close()
+	}
+
+	noopReappliedEventSink struct{}
+)
+
+func newNoopReappliedEventSink() ReappliedEventSink {
+	return &noopReappliedEventSink{}
+}
+
+func (*noopReappliedEventSink) Publish(context.Context, *ReappliedEventEnvelope) error {
+	return nil
+}
+
+func (*noopReappliedEventSink) Close() {}
+
+// newReappliedEventEnvelope builds the CloudEvents envelope for a reapplied
+// event. attr is the event's type-specific attributes struct (e.g.
+// *shared.WorkflowExecutionSignaledEventAttributes), serialized as the
+// envelope's data.
+func newReappliedEventEnvelope(
+	clusterName string,
+	domainID string,
+	workflowID string,
+	runID string,
+	event *shared.HistoryEvent,
+	attr interface{},
+) (*ReappliedEventEnvelope, error) {
+
+	data, err := json.Marshal(attr)
+	if err != nil {
+		return nil, err
+	}
+	return &ReappliedEventEnvelope{
+		SpecVersion:     "1.0",
+		Type:            fmt.Sprintf("cadence.history.event.reapplied.%s", event.GetEventType().String()),
+		Source:          fmt.Sprintf("/cadence/%s/%s", clusterName, domainID),
+		ID:              fmt.Sprintf("%s:%d:%d", runID, event.GetEventId(), event.GetVersion()),
+		Subject:         workflowID,
+		DataContentType: "application/json",
+		Data:            data,
+	}, nil
+}
+
+type (
+	// HTTPReappliedEventSinkConfig configures an HTTP POST
+	// ReappliedEventSink.
+	HTTPReappliedEventSinkConfig struct {
+		URL           string
+		BatchSize     int
+		FlushInterval time.Duration
+		HTTPClient    *http.Client
+	}
+
+	httpReappliedEventSink struct {
+		config HTTPReappliedEventSinkConfig
+		policy backoff.RetryPolicy
+
+		mu      sync.Mutex
+		pending []*ReappliedEventEnvelope
+
+		ticker   *time.Ticker
+		shutdown chan struct{}
+		done     chan struct{}
+	}
+
+	// nonRetryableHTTPStatusError marks a 4xx response from the sink
+	// endpoint as not worth retrying.
+	nonRetryableHTTPStatusError struct {
+		statusCode int
+	}
+)
+
+func (e *nonRetryableHTTPStatusError) Error() string {
+	return fmt.Sprintf("reapplied event sink: non-retryable status code %d", e.statusCode)
+}
+
+// NewHTTPReappliedEventSink returns a ReappliedEventSink that batches
+// envelopes and flushes them with an at-least-once HTTP POST, retrying
+// transient failures with exponential backoff. If config.FlushInterval is
+// set, a background goroutine also flushes whatever is pending on that
+// cadence, so a batch smaller than config.BatchSize is not stranded
+// indefinitely. Callers that construct a sink with a non-zero FlushInterval
+// must call Close when done with it to stop that goroutine.
+func NewHTTPReappliedEventSink(config HTTPReappliedEventSinkConfig) ReappliedEventSink {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	s := &httpReappliedEventSink{
+		config: config,
+		policy: createNDCReapplyEventsRetryPolicy(),
+	}
+	if config.FlushInterval > 0 {
+		s.ticker = time.NewTicker(config.FlushInterval)
+		s.shutdown = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.runFlushLoop()
+	}
+	return s
+}
+
+func (s *httpReappliedEventSink) Publish(ctx context.Context, envelope *ReappliedEventEnvelope) error {
+	batch := s.enqueue(envelope)
+	if batch == nil {
+		return nil
+	}
+	return s.flush(ctx, batch)
+}
+
+// Close stops the interval flush goroutine started for a non-zero
+// FlushInterval, flushing whatever batch is still pending before returning.
+// It is a no-op if the sink was created without a FlushInterval.
+func (s *httpReappliedEventSink) Close() {
+	if s.ticker == nil {
+		return
+	}
+	close(s.shutdown)
+	<-s.done
+	s.ticker.Stop()
+}
+
+// runFlushLoop periodically flushes whatever batch is pending, so events
+// enqueued between two calls to Publish are not held forever waiting for
+// config.BatchSize to be reached.
+func (s *httpReappliedEventSink) runFlushLoop() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.ticker.C:
+			s.flushPending()
+		case <-s.shutdown:
+			s.flushPending()
+			return
+		}
+	}
+}
+
+func (s *httpReappliedEventSink) flushPending() {
+	batch := s.takePending()
+	if len(batch) == 0 {
+		return
+	}
+	// The interval flush runs in the background with no caller waiting on
+	// it, so a failure here is discarded: it is neither returned nor logged,
+	// since the sink holds no logger. Unlike a synchronous Publish, this
+	// flush never blocks or fails reapplication.
+	_ = s.flush(context.Background(), batch)
+}
+
+func (s *httpReappliedEventSink) enqueue(envelope *ReappliedEventEnvelope) []*ReappliedEventEnvelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, envelope)
+	if len(s.pending) < s.config.BatchSize {
+		return nil
+	}
+	batch := s.pending
+	s.pending = nil
+	return batch
+}
+
+func (s *httpReappliedEventSink) takePending() []*ReappliedEventEnvelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := s.pending
+	s.pending = nil
+	return batch
+}
+
+func (s *httpReappliedEventSink) flush(ctx context.Context, batch []*ReappliedEventEnvelope) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	op := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/cloudevents-batch+json")
+
+		resp, err := s.config.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= http.StatusInternalServerError:
+			return fmt.Errorf("reapplied event sink: server error: status code %d", resp.StatusCode)
+		case resp.StatusCode >= http.StatusBadRequest:
+			return &nonRetryableHTTPStatusError{statusCode: resp.StatusCode}
+		default:
+			return nil
+		}
+	}
+	return backoff.Retry(op, s.policy, isHTTPSinkErrorRetryable)
+}
+
+func isHTTPSinkErrorRetryable(err error) bool {
+	var nonRetryable *nonRetryableHTTPStatusError
+	return !errors.As(err, &nonRetryable)
+}
+
+type (
+	// KafkaReappliedEventSinkConfig configures the Kafka sink stub.
+	KafkaReappliedEventSinkConfig struct {
+		Topic   string
+		Brokers []string
+	}
+
+	kafkaReappliedEventSink struct {
+		config KafkaReappliedEventSinkConfig
+	}
+)
+
+// errKafkaSinkNotImplemented is returned by kafkaReappliedEventSink until a
+// real producer is wired up.
+var errKafkaSinkNotImplemented = errors.New("kafka reapplied event sink is not implemented")
+
+// NewKafkaReappliedEventSink returns a Kafka-backed ReappliedEventSink stub.
+// TODO: back this with a real producer (see common/messaging) once the
+// topic and serialization format for reapplied events are finalized.
+func NewKafkaReappliedEventSink(config KafkaReappliedEventSinkConfig) ReappliedEventSink {
+	return &kafkaReappliedEventSink{config: config}
+}
+
+func (s *kafkaReappliedEventSink) Publish(context.Context, *ReappliedEventEnvelope) error {
+	return errKafkaSinkNotImplemented
+}
+
+func (s *kafkaReappliedEventSink) Close() {}
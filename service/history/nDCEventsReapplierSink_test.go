@@ -0,0 +1,208 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/uber/cadence/.gen/go/shared"
+	"github.com/uber/cadence/common"
+)
+
+type (
+	nDCEventsReapplierSinkSuite struct {
+		suite.Suite
+		*require.Assertions
+	}
+)
+
+func TestNDCEventsReapplierSinkSuite(t *testing.T) {
+	s := new(nDCEventsReapplierSinkSuite)
+	suite.Run(t, s)
+}
+
+func (s *nDCEventsReapplierSinkSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+}
+
+func (s *nDCEventsReapplierSinkSuite) TestNewReappliedEventEnvelope_MarshalsCloudEventsWireNames() {
+	runID := uuid.New()
+	domainID := uuid.New()
+	event := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(5),
+		Version:   common.Int64Ptr(2),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+	}
+	attr := &shared.WorkflowExecutionSignaledEventAttributes{
+		SignalName: common.StringPtr("signal"),
+	}
+
+	envelope, err := newReappliedEventEnvelope("cluster0", domainID, "test-workflow", runID, event, attr)
+	s.NoError(err)
+
+	wire, err := json.Marshal(envelope)
+	s.NoError(err)
+
+	var onWire map[string]interface{}
+	s.NoError(json.Unmarshal(wire, &onWire))
+
+	// CloudEvents 1.0 mandates lowercase attribute names on the wire; this
+	// is what an external consumer actually parses, unlike the Go field
+	// names the struct happens to use internally.
+	for _, attrName := range []string{"specversion", "type", "source", "id", "subject", "datacontenttype", "data"} {
+		s.Contains(onWire, attrName, "missing CloudEvents wire attribute %q", attrName)
+	}
+	for _, goName := range []string{"SpecVersion", "Type", "Source", "ID", "Subject", "DataContentType", "Data"} {
+		s.NotContains(onWire, goName, "wire payload must not use the Go field name %q", goName)
+	}
+
+	s.Equal("1.0", onWire["specversion"])
+	s.Equal("cadence.history.event.reapplied.WorkflowExecutionSignaled", onWire["type"])
+	s.Equal("/cadence/cluster0/"+domainID, onWire["source"])
+	s.Equal(runID+":5:2", onWire["id"])
+	s.Equal("test-workflow", onWire["subject"])
+	s.Equal("application/json", onWire["datacontenttype"])
+}
+
+func (s *nDCEventsReapplierSinkSuite) TestHTTPReappliedEventSink_FlushesFullBatch() {
+	var (
+		mu       sync.Mutex
+		received [][]*ReappliedEventEnvelope
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []*ReappliedEventEnvelope
+		s.NoError(json.NewDecoder(r.Body).Decode(&batch))
+		mu.Lock()
+		received = append(received, batch)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPReappliedEventSink(HTTPReappliedEventSinkConfig{
+		URL:       server.URL,
+		BatchSize: 2,
+	})
+
+	for i := 0; i < 2; i++ {
+		envelope, err := newReappliedEventEnvelope("cluster0", uuid.New(), "wf", uuid.New(), &shared.HistoryEvent{
+			EventId:   common.Int64Ptr(int64(i)),
+			EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		}, &shared.WorkflowExecutionSignaledEventAttributes{})
+		s.NoError(err)
+		s.NoError(sink.Publish(context.Background(), envelope))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	s.Len(received, 1)
+	s.Len(received[0], 2)
+}
+
+func (s *nDCEventsReapplierSinkSuite) TestHTTPReappliedEventSink_RetriesServerError() {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPReappliedEventSink(HTTPReappliedEventSinkConfig{
+		URL:       server.URL,
+		BatchSize: 1,
+	})
+
+	envelope, err := newReappliedEventEnvelope("cluster0", uuid.New(), "wf", uuid.New(), &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+	}, &shared.WorkflowExecutionSignaledEventAttributes{})
+	s.NoError(err)
+	s.NoError(sink.Publish(context.Background(), envelope))
+	s.GreaterOrEqual(attempts, 2)
+}
+
+func (s *nDCEventsReapplierSinkSuite) TestHTTPReappliedEventSink_DoesNotRetryClientError() {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPReappliedEventSink(HTTPReappliedEventSinkConfig{
+		URL:       server.URL,
+		BatchSize: 1,
+	})
+
+	envelope, err := newReappliedEventEnvelope("cluster0", uuid.New(), "wf", uuid.New(), &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+	}, &shared.WorkflowExecutionSignaledEventAttributes{})
+	s.NoError(err)
+	s.Error(sink.Publish(context.Background(), envelope))
+	s.Equal(1, attempts)
+}
+
+func (s *nDCEventsReapplierSinkSuite) TestHTTPReappliedEventSink_FlushesPartialBatchOnInterval() {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []*ReappliedEventEnvelope
+		s.NoError(json.NewDecoder(r.Body).Decode(&batch))
+		w.WriteHeader(http.StatusOK)
+		close(done)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPReappliedEventSink(HTTPReappliedEventSinkConfig{
+		URL:           server.URL,
+		BatchSize:     100,
+		FlushInterval: 5 * time.Millisecond,
+	})
+	defer sink.Close()
+
+	envelope, err := newReappliedEventEnvelope("cluster0", uuid.New(), "wf", uuid.New(), &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+	}, &shared.WorkflowExecutionSignaledEventAttributes{})
+	s.NoError(err)
+	s.NoError(sink.Publish(context.Background(), envelope))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		s.Fail("partial batch below BatchSize was never flushed by the interval ticker")
+	}
+}
+
@@ -23,7 +23,10 @@ package history
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/pborman/uuid"
@@ -239,3 +242,378 @@ func (s *nDCEventReapplicationSuite) TestReapplyEvents_Error() {
 	s.Error(err)
 	s.Equal(0, len(reappliedEvent))
 }
+
+func (s *nDCEventReapplicationSuite) TestReapplyEvents_MixedTypes_PartialDedup() {
+	runID := uuid.New()
+	signalEvent := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal"),
+			Input:      []byte{},
+		},
+	}
+	cancelEvent := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(2),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionCancelRequested),
+		WorkflowExecutionCancelRequestedEventAttributes: &shared.WorkflowExecutionCancelRequestedEventAttributes{
+			Cause:    common.StringPtr("test-cause"),
+			Identity: common.StringPtr("test"),
+		},
+	}
+	// already reapplied on a prior pass; must be skipped without touching mutableState
+	terminateEvent := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(3),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionTerminated),
+		WorkflowExecutionTerminatedEventAttributes: &shared.WorkflowExecutionTerminatedEventAttributes{
+			Reason:   common.StringPtr("test-reason"),
+			Details:  []byte{},
+			Identity: common.StringPtr("test"),
+		},
+	}
+	signalAttr := signalEvent.WorkflowExecutionSignaledEventAttributes
+	cancelAttr := cancelEvent.WorkflowExecutionCancelRequestedEventAttributes
+
+	msBuilderCurrent := NewMockmutableState(s.controller)
+	msBuilderCurrent.EXPECT().IsWorkflowExecutionRunning().Return(true).Times(2)
+	msBuilderCurrent.EXPECT().AddWorkflowExecutionSignaled(
+		signalAttr.GetSignalName(),
+		signalAttr.GetInput(),
+		signalAttr.GetIdentity(),
+	).Return(signalEvent, nil).Times(1)
+	msBuilderCurrent.EXPECT().AddWorkflowExecutionCancelRequestedEvent(
+		cancelAttr.GetCause(),
+		cancelAttr.GetIdentity(),
+	).Return(cancelEvent, nil).Times(1)
+	msBuilderCurrent.EXPECT().IsEventReapplied(
+		runID,
+		signalEvent.GetEventId(),
+		signalEvent.GetVersion(),
+	).Return(false).Times(1)
+	msBuilderCurrent.EXPECT().IsEventReapplied(
+		runID,
+		cancelEvent.GetEventId(),
+		cancelEvent.GetVersion(),
+	).Return(false).Times(1)
+	msBuilderCurrent.EXPECT().IsEventReapplied(
+		runID,
+		terminateEvent.GetEventId(),
+		terminateEvent.GetVersion(),
+	).Return(true).Times(1)
+	msBuilderCurrent.EXPECT().UpdateReappliedEvent(
+		runID,
+		signalEvent.GetEventId(),
+		signalEvent.GetVersion(),
+	).Times(1)
+	msBuilderCurrent.EXPECT().UpdateReappliedEvent(
+		runID,
+		cancelEvent.GetEventId(),
+		cancelEvent.GetVersion(),
+	).Times(1)
+	events := []*shared.HistoryEvent{
+		signalEvent,
+		cancelEvent,
+		terminateEvent,
+	}
+	reappliedEvent, err := s.nDCReapplication.reapplyEvents(context.Background(), msBuilderCurrent, events, runID)
+	s.NoError(err)
+	s.Equal(2, len(reappliedEvent))
+}
+
+func (s *nDCEventReapplicationSuite) TestReapplyEvents_ExternalCompletion_OptOutByDefault() {
+	runID := uuid.New()
+	event := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeChildWorkflowExecutionCompleted),
+		ChildWorkflowExecutionCompletedEventAttributes: &shared.ChildWorkflowExecutionCompletedEventAttributes{
+			WorkflowExecution: &shared.WorkflowExecution{
+				WorkflowId: common.StringPtr("child"),
+				RunId:      common.StringPtr(uuid.New()),
+			},
+		},
+	}
+
+	// default policy does not reapply external completion events, so no
+	// mutableState calls are expected at all.
+	msBuilderCurrent := NewMockmutableState(s.controller)
+	events := []*shared.HistoryEvent{event}
+	reappliedEvent, err := s.nDCReapplication.reapplyEvents(context.Background(), msBuilderCurrent, events, runID)
+	s.NoError(err)
+	s.Equal(0, len(reappliedEvent))
+}
+
+func (s *nDCEventReapplicationSuite) TestReapplyEvents_ExternalCompletion_AllTerminalTypesReapplied() {
+	logger := loggerimpl.NewDevelopmentForTest(s.Suite)
+	metricsClient := metrics.NewClient(tally.NoopScope, metrics.History)
+	reapplier := newNDCEventsReapplier(
+		metricsClient,
+		logger,
+		WithNDCEventReapplyPolicy(NDCEventReapplyPolicy{ReapplyExternalCompletion: true}),
+	)
+
+	childExecution := &shared.WorkflowExecution{
+		WorkflowId: common.StringPtr("child"),
+		RunId:      common.StringPtr(uuid.New()),
+	}
+
+	testCases := []struct {
+		name      string
+		eventType shared.EventType
+		event     *shared.HistoryEvent
+	}{
+		{
+			name:      "completed",
+			eventType: shared.EventTypeChildWorkflowExecutionCompleted,
+			event: &shared.HistoryEvent{
+				ChildWorkflowExecutionCompletedEventAttributes: &shared.ChildWorkflowExecutionCompletedEventAttributes{
+					InitiatedEventId:  common.Int64Ptr(1),
+					WorkflowExecution: childExecution,
+				},
+			},
+		},
+		{
+			name:      "failed",
+			eventType: shared.EventTypeChildWorkflowExecutionFailed,
+			event: &shared.HistoryEvent{
+				ChildWorkflowExecutionFailedEventAttributes: &shared.ChildWorkflowExecutionFailedEventAttributes{
+					InitiatedEventId:  common.Int64Ptr(1),
+					WorkflowExecution: childExecution,
+				},
+			},
+		},
+		{
+			name:      "canceled",
+			eventType: shared.EventTypeChildWorkflowExecutionCanceled,
+			event: &shared.HistoryEvent{
+				ChildWorkflowExecutionCanceledEventAttributes: &shared.ChildWorkflowExecutionCanceledEventAttributes{
+					InitiatedEventId:  common.Int64Ptr(1),
+					WorkflowExecution: childExecution,
+				},
+			},
+		},
+		{
+			name:      "timed out",
+			eventType: shared.EventTypeChildWorkflowExecutionTimedOut,
+			event: &shared.HistoryEvent{
+				ChildWorkflowExecutionTimedOutEventAttributes: &shared.ChildWorkflowExecutionTimedOutEventAttributes{
+					InitiatedEventId:  common.Int64Ptr(1),
+					WorkflowExecution: childExecution,
+				},
+			},
+		},
+		{
+			name:      "terminated",
+			eventType: shared.EventTypeChildWorkflowExecutionTerminated,
+			event: &shared.HistoryEvent{
+				ChildWorkflowExecutionTerminatedEventAttributes: &shared.ChildWorkflowExecutionTerminatedEventAttributes{
+					InitiatedEventId:  common.Int64Ptr(1),
+					WorkflowExecution: childExecution,
+				},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		runID := uuid.New()
+		event := tc.event
+		event.EventId = common.Int64Ptr(int64(i + 1))
+		event.EventType = common.EventTypePtr(tc.eventType)
+
+		msBuilderCurrent := NewMockmutableState(s.controller)
+		msBuilderCurrent.EXPECT().IsWorkflowExecutionRunning().Return(true)
+		msBuilderCurrent.EXPECT().IsEventReapplied(runID, event.GetEventId(), event.GetVersion()).Return(false)
+		msBuilderCurrent.EXPECT().UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+
+		switch tc.eventType {
+		case shared.EventTypeChildWorkflowExecutionCompleted:
+			attr := event.ChildWorkflowExecutionCompletedEventAttributes
+			msBuilderCurrent.EXPECT().AddChildWorkflowExecutionCompletedEvent(
+				attr.GetInitiatedEventId(), attr.GetWorkflowExecution(), attr,
+			).Return(event, nil)
+		case shared.EventTypeChildWorkflowExecutionFailed:
+			attr := event.ChildWorkflowExecutionFailedEventAttributes
+			msBuilderCurrent.EXPECT().AddChildWorkflowExecutionFailedEvent(
+				attr.GetInitiatedEventId(), attr.GetWorkflowExecution(), attr,
+			).Return(event, nil)
+		case shared.EventTypeChildWorkflowExecutionCanceled:
+			attr := event.ChildWorkflowExecutionCanceledEventAttributes
+			msBuilderCurrent.EXPECT().AddChildWorkflowExecutionCanceledEvent(
+				attr.GetInitiatedEventId(), attr.GetWorkflowExecution(), attr,
+			).Return(event, nil)
+		case shared.EventTypeChildWorkflowExecutionTimedOut:
+			attr := event.ChildWorkflowExecutionTimedOutEventAttributes
+			msBuilderCurrent.EXPECT().AddChildWorkflowExecutionTimedOutEvent(
+				attr.GetInitiatedEventId(), attr.GetWorkflowExecution(), attr,
+			).Return(event, nil)
+		case shared.EventTypeChildWorkflowExecutionTerminated:
+			attr := event.ChildWorkflowExecutionTerminatedEventAttributes
+			msBuilderCurrent.EXPECT().AddChildWorkflowExecutionTerminatedEvent(
+				attr.GetInitiatedEventId(), attr.GetWorkflowExecution(), attr,
+			).Return(event, nil)
+		}
+
+		reappliedEvent, err := reapplier.reapplyEvents(context.Background(), msBuilderCurrent, []*shared.HistoryEvent{event}, runID)
+		s.NoError(err, tc.name)
+		s.Equal(1, len(reappliedEvent), tc.name)
+	}
+}
+
+func (s *nDCEventReapplicationSuite) TestGetPingChecks_ReportsStuckReapply() {
+	runID := uuid.New()
+	domainID := uuid.New()
+	execution := &persistence.WorkflowExecutionInfo{
+		DomainID: domainID,
+	}
+	event := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal"),
+			Input:      []byte{},
+		},
+	}
+	attr := event.WorkflowExecutionSignaledEventAttributes
+
+	blockCh := make(chan struct{})
+	logger := loggerimpl.NewDevelopmentForTest(s.Suite)
+	metricsClient := metrics.NewClient(tally.NoopScope, metrics.History)
+	reapplier := newNDCEventsReapplier(
+		metricsClient,
+		logger,
+		WithNDCReapplyPingDeadline(time.Millisecond),
+	)
+	pingable, ok := reapplier.(common.Pingable)
+	s.True(ok)
+
+	msBuilderCurrent := NewMockmutableState(s.controller)
+	msBuilderCurrent.EXPECT().IsWorkflowExecutionRunning().Return(true)
+	msBuilderCurrent.EXPECT().GetExecutionInfo().Return(execution).AnyTimes()
+	msBuilderCurrent.EXPECT().IsEventReapplied(runID, event.GetEventId(), event.GetVersion()).Return(false)
+	msBuilderCurrent.EXPECT().AddWorkflowExecutionSignaled(
+		attr.GetSignalName(), attr.GetInput(), attr.GetIdentity(),
+	).DoAndReturn(func(string, []byte, string) (*shared.HistoryEvent, error) {
+		<-blockCh
+		return event, nil
+	}).Times(1)
+	msBuilderCurrent.EXPECT().UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := reapplier.reapplyEvents(context.Background(), msBuilderCurrent, []*shared.HistoryEvent{event}, runID)
+		s.NoError(err)
+	}()
+
+	s.Eventually(func() bool {
+		checks := pingable.GetPingChecks()
+		s.Len(checks, 1)
+		offenders := checks[0].Ping()
+		if len(offenders) == 0 {
+			return false
+		}
+		s.True(strings.Contains(offenders[0], domainID))
+		s.True(strings.Contains(offenders[0], runID))
+		return true
+	}, time.Second, time.Millisecond)
+
+	close(blockCh)
+	wg.Wait()
+}
+
+type fakeReappliedEventSink struct {
+	mu        sync.Mutex
+	envelopes []*ReappliedEventEnvelope
+}
+
+func (f *fakeReappliedEventSink) Publish(_ context.Context, envelope *ReappliedEventEnvelope) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.envelopes = append(f.envelopes, envelope)
+	return nil
+}
+
+func (f *fakeReappliedEventSink) Close() {}
+
+func (f *fakeReappliedEventSink) Envelopes() []*ReappliedEventEnvelope {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.envelopes
+}
+
+func (s *nDCEventReapplicationSuite) TestReapplyEvents_PublishesOneEnvelopePerReappliedEvent() {
+	runID := uuid.New()
+	domainID := uuid.New()
+	execution := &persistence.WorkflowExecutionInfo{
+		DomainID:   domainID,
+		WorkflowID: "test-workflow",
+	}
+	event := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal"),
+			Input:      []byte{},
+		},
+	}
+	attr := event.WorkflowExecutionSignaledEventAttributes
+
+	sink := &fakeReappliedEventSink{}
+	logger := loggerimpl.NewDevelopmentForTest(s.Suite)
+	metricsClient := metrics.NewClient(tally.NoopScope, metrics.History)
+	reapplier := newNDCEventsReapplier(
+		metricsClient,
+		logger,
+		WithReappliedEventSink(sink),
+		WithClusterName("cluster0"),
+	)
+
+	msBuilderCurrent := NewMockmutableState(s.controller)
+	msBuilderCurrent.EXPECT().IsWorkflowExecutionRunning().Return(true)
+	msBuilderCurrent.EXPECT().GetExecutionInfo().Return(execution).AnyTimes()
+	msBuilderCurrent.EXPECT().IsEventReapplied(runID, event.GetEventId(), event.GetVersion()).Return(false)
+	msBuilderCurrent.EXPECT().AddWorkflowExecutionSignaled(
+		attr.GetSignalName(), attr.GetInput(), attr.GetIdentity(),
+	).Return(event, nil)
+	msBuilderCurrent.EXPECT().UpdateReappliedEvent(runID, event.GetEventId(), event.GetVersion())
+
+	reappliedEvents, err := reapplier.reapplyEvents(context.Background(), msBuilderCurrent, []*shared.HistoryEvent{event}, runID)
+	s.NoError(err)
+	s.Len(reappliedEvents, 1)
+
+	envelopes := sink.Envelopes()
+	s.Len(envelopes, 1)
+	s.Equal(fmt.Sprintf("%s:%d:%d", runID, event.GetEventId(), event.GetVersion()), envelopes[0].ID)
+	s.Equal("test-workflow", envelopes[0].Subject)
+	s.Equal(fmt.Sprintf("/cadence/cluster0/%s", domainID), envelopes[0].Source)
+	s.Equal("cadence.history.event.reapplied.WorkflowExecutionSignaled", envelopes[0].Type)
+}
+
+func (s *nDCEventReapplicationSuite) TestReapplyEvents_DedupSkipProducesNoEnvelope() {
+	runID := uuid.New()
+	event := &shared.HistoryEvent{
+		EventId:   common.Int64Ptr(1),
+		EventType: common.EventTypePtr(shared.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &shared.WorkflowExecutionSignaledEventAttributes{
+			Identity:   common.StringPtr("test"),
+			SignalName: common.StringPtr("signal"),
+			Input:      []byte{},
+		},
+	}
+
+	sink := &fakeReappliedEventSink{}
+	logger := loggerimpl.NewDevelopmentForTest(s.Suite)
+	metricsClient := metrics.NewClient(tally.NoopScope, metrics.History)
+	reapplier := newNDCEventsReapplier(metricsClient, logger, WithReappliedEventSink(sink))
+
+	msBuilderCurrent := NewMockmutableState(s.controller)
+	msBuilderCurrent.EXPECT().IsEventReapplied(runID, event.GetEventId(), event.GetVersion()).Return(true)
+
+	reappliedEvents, err := reapplier.reapplyEvents(context.Background(), msBuilderCurrent, []*shared.HistoryEvent{event}, runID)
+	s.NoError(err)
+	s.Len(reappliedEvents, 0)
+	s.Len(sink.Envelopes(), 0)
+}